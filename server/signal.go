@@ -16,13 +16,19 @@
 package server
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	natsd "github.com/nats-io/gnatsd/server"
 )
 
+// acmeShutdownTimeout bounds how long handleSignals waits for the
+// HTTP-01 challenge responder to shut down before giving up.
+const acmeShutdownTimeout = 5 * time.Second
+
 func init() {
 	// Set the process name so signal code use this process name
 	// instead of gnatsd.
@@ -30,7 +36,20 @@ func init() {
 }
 
 // Signal Handling
+// handleSignals installs the process's signal handlers. It also calls
+// PrepareClientTLSConfig as a fallback for ACME setup, in case nothing
+// upstream of this call already did so before constructing the client
+// TLS listener - see that function's doc for why that earlier call is
+// the one that actually matters, and why calling it again here is
+// safe. This fallback call keeps the HTTP-01 responder and certificate
+// renewal running even if the listener wiring is missing, but it
+// cannot retroactively hand the managed tls.Config to a listener that
+// already started with a static one.
 func (s *StanServer) handleSignals() {
+	if _, err := s.PrepareClientTLSConfig(); err != nil {
+		s.log.Errorf("acme: unable to set up certificate management: %v", err)
+	}
+
 	c := make(chan os.Signal, 1)
 	//2018-09-08
 	//signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP)
@@ -41,17 +60,32 @@ func (s *StanServer) handleSignals() {
 			// registered, so we don't need a "default" in the
 			// switch statement.
 			switch sig {
-			case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGQUIT:
+			case syscall.SIGINT, syscall.SIGKILL, syscall.SIGQUIT:
                 //2018-06-13
                 s.log.Noticef("get signal:%v, will UnRegister()", sig)
                 s.opts.ConsulUtil.UnRegister()
+				s.stopACMEIfEnabled()
 				s.Shutdown()
 				os.Exit(0)
+			case syscall.SIGTERM:
+				// Unlike the other termination signals, SIGTERM goes
+				// through Drain before shutting down; see Drain for what
+				// it does and does not wait for. The exit code is 0 when
+				// Drain reports a clean drain and 1 otherwise, so
+				// orchestrators like Kubernetes can tell the two apart.
+				s.log.Noticef("get signal:%v, draining before shutdown", sig)
+				if s.Drain(s.opts.DrainTimeout) {
+					os.Exit(0)
+				}
+				os.Exit(1)
 			case syscall.SIGUSR1:
 				// File log re-open for rotating file logs.
 				s.log.ReopenLogFile()
 			case syscall.SIGHUP:
-				// Ignore for now
+				// Ask the ACME manager for each domain's certificate;
+				// see reloadACMECert for what this does and does not
+				// reload.
+				s.reloadACMECert(s.opts.ACME)
 			}
 		}
 	}()
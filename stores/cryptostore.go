@@ -1,9 +1,11 @@
 package stores
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"io"
 	"os"
@@ -12,12 +14,84 @@ import (
 	"time"
 
 	"github.com/nats-io/go-nats-streaming/pb"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
 )
 
 // CryptStore specific errors
 var (
-	ErrCryptoStoreRequiresKey = errors.New("crypto store requires a key")
+	ErrCryptoStoreRequiresKey    = errors.New("crypto store requires a key")
+	ErrCryptoStoreUnknownKey     = errors.New("crypto store has no such key")
+	ErrCryptoStoreUnknownCipher  = errors.New("crypto store: unknown cipher suite")
+	ErrCryptoStoreUnknownKDF     = errors.New("crypto store: unknown key derivation function")
+	ErrCryptoStoreCipherMismatch = errors.New("crypto store: message was not encrypted with the expected cipher suite")
+	ErrCryptoStoreUnknownMode    = errors.New("crypto store: unknown envelope mode")
+	ErrCryptoStoreShortEnvelope  = errors.New("crypto store: encrypted record is too short to be a valid envelope")
+)
+
+// Envelope modes stored in the header of every encrypted message,
+// right after the cipher ID, so decrypt knows how to lay out the rest
+// of the envelope.
+const (
+	// envelopeSingleFrame is the historical layout: [nonce][ciphertext+tag].
+	envelopeSingleFrame byte = iota
+	// envelopeChunked splits the payload into fixed-size frames, each
+	// sealed with its own nonce derived from a per-message base nonce.
+	// Layout: [chunkSize uint32][baseNonce][frame]...[frame].
+	envelopeChunked
+)
+
+// CipherSuite identifies the AEAD construction used by a cryptoKey.
+// The numeric value is persisted in the header of every encrypted
+// message, so existing values must never be renumbered.
+type CipherSuite byte
+
+// Supported cipher suites for CryptoStore.
+const (
+	// ChaCha20Poly1305 is the suite CryptoStore has always used.
+	ChaCha20Poly1305 CipherSuite = iota
+	// XChaCha20Poly1305 uses a 24-byte nonce, which removes the need
+	// to ever renew the nonce for the lifetime of a key.
+	XChaCha20Poly1305
+	// AES128GCM uses AES-GCM with a 128-bit key.
+	AES128GCM
+	// AES256GCM uses AES-GCM with a 256-bit key.
+	AES256GCM
+)
+
+// KDF identifies how a user-supplied key string is turned into the
+// raw key bytes used by a CipherSuite. The numeric value is not
+// persisted; it only matters at store creation/rotation time.
+type KDF byte
+
+// Supported key derivation functions for CryptoStore.
+const (
+	// RawSHA256 hashes the key string with SHA-256, as CryptoStore
+	// has always done. It is fast but offers no brute-force
+	// resistance for low-entropy passphrases.
+	RawSHA256 KDF = iota
+	// PBKDF2SHA256 runs the key string through PBKDF2 with SHA-256.
+	PBKDF2SHA256
+	// Scrypt runs the key string through the scrypt KDF.
+	Scrypt
+	// Argon2id runs the key string through the Argon2id KDF.
+	Argon2id
+)
+
+const (
+	// Iteration/cost parameters for the KDFs above. These favor
+	// interactive startup latency over maximum brute-force
+	// resistance, consistent with this being a defense-in-depth
+	// option rather than the store's only protection.
+	kdfPBKDF2Iterations = 100000
+	kdfScryptN          = 1 << 15
+	kdfScryptR          = 8
+	kdfScryptP          = 1
+	kdfArgon2Time       = 1
+	kdfArgon2Memory     = 64 * 1024
+	kdfArgon2Threads    = 4
 )
 
 const (
@@ -26,6 +100,11 @@ const (
 	// a parameter.
 	CryptoStoreEnvKeyName = "NATS_STREAMING_ENCRYPTION_KEY"
 
+	// cryptoStoreDefaultKeyID is the key ID used when a caller
+	// creates a CryptoStore through NewCryptoStore, which only
+	// knows about a single key.
+	cryptoStoreDefaultKeyID = "default"
+
 	// Seal() should be called at most 2^32 with the same nonce.
 	// Use this as the max threshold, after which the nonce is
 	// renewed.
@@ -37,20 +116,294 @@ var (
 	csMaxEncryptCallsPerNonce = csDefaultMaxEncryptCallsPerNonce
 )
 
-// CryptoStore is a store wrapping a store implementation
-// and adds encryption support.
-type CryptoStore struct {
+// cryptoKey holds the AEAD cipher and nonce state for a single
+// encryption key known to a CryptoStore. A CryptoStore can hold
+// several of these simultaneously so that messages encrypted
+// under an older key remain decryptable after a key rotation.
+type cryptoKey struct {
 	// These are used with atomic operations. Keep them 64-bit aligned.
 	inEncrypt int64
 	encrypted int64
 
+	sync.Mutex
+
+	id              string
+	cipher          CipherSuite
+	gcm             cipher.AEAD
+	nonce           []byte
+	nonceSize       int
+	cryptoOverhead  int
+	maxEncryptCalls int64
+}
+
+// deriveKeyBytes turns the user-supplied key string into raw key
+// material of the given length, using the requested KDF. For PBKDF2,
+// scrypt and Argon2id, id is mixed in as the salt so that two keys
+// using the same passphrase under different IDs don't end up with the
+// same derived bytes. RawSHA256 ignores id and hashes only the key
+// string, so it derives the same bytes CryptoStore always has.
+func deriveKeyBytes(kdf KDF, id, key string, keyLen int) ([]byte, error) {
+	salt := []byte(id)
+	switch kdf {
+	case RawSHA256:
+		h := sha256.New()
+		h.Write([]byte(key))
+		return h.Sum(nil)[:keyLen], nil
+	case PBKDF2SHA256:
+		return pbkdf2.Key([]byte(key), salt, kdfPBKDF2Iterations, keyLen, sha256.New), nil
+	case Scrypt:
+		return scrypt.Key([]byte(key), salt, kdfScryptN, kdfScryptR, kdfScryptP, keyLen)
+	case Argon2id:
+		return argon2.IDKey([]byte(key), salt, kdfArgon2Time, kdfArgon2Memory, kdfArgon2Threads, uint32(keyLen)), nil
+	default:
+		return nil, ErrCryptoStoreUnknownKDF
+	}
+}
+
+func newAEAD(cipherSuite CipherSuite, id, key string, kdf KDF) (cipher.AEAD, error) {
+	switch cipherSuite {
+	case ChaCha20Poly1305:
+		keyBytes, err := deriveKeyBytes(kdf, id, key, chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		return chacha20poly1305.New(keyBytes)
+	case XChaCha20Poly1305:
+		keyBytes, err := deriveKeyBytes(kdf, id, key, chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		return chacha20poly1305.NewX(keyBytes)
+	case AES128GCM:
+		keyBytes, err := deriveKeyBytes(kdf, id, key, 16)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AES256GCM:
+		keyBytes, err := deriveKeyBytes(kdf, id, key, 32)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, ErrCryptoStoreUnknownCipher
+	}
+}
+
+func newCryptoKey(id, key string, cipherSuite CipherSuite, kdf KDF) (*cryptoKey, error) {
+	gcm, err := newAEAD(cipherSuite, id, key, kdf)
+	if err != nil {
+		return nil, err
+	}
+	maxCalls := csMaxEncryptCallsPerNonce
+	if cipherSuite == XChaCha20Poly1305 {
+		// The 24-byte nonce makes collision risk negligible for the
+		// lifetime of a key, so there is no need to pay the cost of
+		// periodically renewing it.
+		maxCalls = int64(1) << 62
+	}
+	ck := &cryptoKey{
+		id:              id,
+		cipher:          cipherSuite,
+		gcm:             gcm,
+		cryptoOverhead:  gcm.Overhead(),
+		nonceSize:       gcm.NonceSize(),
+		maxEncryptCalls: maxCalls,
+	}
+	if err := ck.generateNewNonce(); err != nil {
+		return nil, err
+	}
+	return ck, nil
+}
+
+func (ck *cryptoKey) generateNewNonce() error {
+	nonce := make([]byte, ck.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	ck.nonce = nonce
+	atomic.StoreInt64(&ck.encrypted, 0)
+	return nil
+}
+
+func (ck *cryptoKey) seal(data []byte) ([]byte, error) {
+CHECK_ENCRYPTED_COUNT:
+	atomic.AddInt64(&ck.inEncrypt, 1)
+	if count := atomic.AddInt64(&ck.encrypted, 1); count >= ck.maxEncryptCalls {
+		atomic.AddInt64(&ck.inEncrypt, -1)
+		ck.Lock()
+		if count == ck.maxEncryptCalls {
+			for atomic.LoadInt64(&ck.inEncrypt) > 0 {
+				time.Sleep(15 * time.Millisecond)
+			}
+			if err := ck.generateNewNonce(); err != nil {
+				ck.Unlock()
+				return nil, err
+			}
+			ck.Unlock()
+			atomic.AddInt64(&ck.inEncrypt, 1)
+		} else {
+			ck.Unlock()
+			goto CHECK_ENCRYPTED_COUNT
+		}
+	}
+	buf := make([]byte, ck.nonceSize+ck.cryptoOverhead+len(data))
+	copy(buf, ck.nonce)
+	copy(buf[ck.nonceSize:], data)
+	dst := buf[ck.nonceSize : ck.nonceSize+len(data)]
+	ret := ck.gcm.Seal(dst[:0], ck.nonce, dst, nil)
+	atomic.AddInt64(&ck.inEncrypt, -1)
+	return buf[:ck.nonceSize+len(ret)], nil
+}
+
+func (ck *cryptoKey) open(data []byte) ([]byte, error) {
+	if len(data) < ck.nonceSize {
+		return nil, ErrCryptoStoreShortEnvelope
+	}
+	return ck.gcm.Open(nil, data[:ck.nonceSize], data[ck.nonceSize:], nil)
+}
+
+// chunkNonce derives the nonce for chunk number counter by XOR-ing it,
+// as a big-endian 64-bit value, into the low bytes of base.
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	var cb [8]byte
+	binary.BigEndian.PutUint64(cb[:], counter)
+	off := len(nonce) - len(cb)
+	for i := range cb {
+		nonce[off+i] ^= cb[i]
+	}
+	return nonce
+}
+
+// sealChunked splits data into chunkSize frames and seals each one
+// under its own nonce, derived from a base nonce generated fresh for
+// this message. Because the base is never reused across messages, it
+// bypasses the shared-nonce renewal bookkeeping that seal uses.
+func (ck *cryptoKey) sealChunked(data []byte, chunkSize int) ([]byte, error) {
+	base := make([]byte, ck.nonceSize)
+	if _, err := io.ReadFull(rand.Reader, base); err != nil {
+		return nil, err
+	}
+	nChunks := (len(data) + chunkSize - 1) / chunkSize
+	out := make([]byte, 0, len(base)+len(data)+nChunks*ck.cryptoOverhead)
+	out = append(out, base...)
+	for i := 0; i < nChunks; i++ {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		nonce := chunkNonce(base, uint64(i))
+		out = ck.gcm.Seal(out, nonce, data[start:end], nil)
+	}
+	return out, nil
+}
+
+// openChunked reverses sealChunked.
+func (ck *cryptoKey) openChunked(data []byte, chunkSize int) ([]byte, error) {
+	if len(data) < ck.nonceSize {
+		return nil, ErrCryptoStoreShortEnvelope
+	}
+	base := data[:ck.nonceSize]
+	rest := data[ck.nonceSize:]
+	frameSize := chunkSize + ck.cryptoOverhead
+	var out []byte
+	for counter := uint64(0); len(rest) > 0; counter++ {
+		n := frameSize
+		if n > len(rest) {
+			n = len(rest)
+		}
+		nonce := chunkNonce(base, counter)
+		plain, err := ck.gcm.Open(nil, nonce, rest[:n], nil)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, plain...)
+		rest = rest[n:]
+	}
+	return out, nil
+}
+
+// CryptoStore is a store wrapping a store implementation
+// and adds encryption support.
+type CryptoStore struct {
 	sync.Mutex
 	Store
 
-	gcm            cipher.AEAD
-	nonce          []byte
-	nonceSize      int
-	cryptoOverhead int
+	keys           map[string]*cryptoKey
+	defaultKeyID   string
+	channelKeys    map[string]string
+	cipher         CipherSuite
+	kdf            KDF
+	chunkSize      int
+	legacyKeyID    string
+	legacySubState bool
+}
+
+// CryptoStoreOptions configures the cipher suite and key derivation
+// function used by NewCryptoStoreWithOptions. The zero values of Cipher
+// and KDF select ChaCha20-Poly1305 with a raw SHA-256 hash of the key,
+// the suite and KDF NewCryptoStore uses. Records are still written in
+// the keyed envelope format either way; see LegacyKeyID for reading
+// records written before that format existed.
+type CryptoStoreOptions struct {
+	// Keys is the set of encryption keys known to the store, indexed
+	// by a stable key ID.
+	Keys map[string]string
+	// DefaultKeyID selects which of Keys is used to encrypt new
+	// messages.
+	DefaultKeyID string
+	// Cipher selects the AEAD construction used for the keys in Keys
+	// and for keys later added with RotateKey. RotateKeyWithOptions can
+	// add keys that use a different one.
+	Cipher CipherSuite
+	// KDF selects how each entry in Keys is turned into raw key
+	// material for Cipher.
+	KDF KDF
+	// ChunkSize, when non-zero, switches messages whose payload is
+	// larger than ChunkSize to a chunked encryption layout: the
+	// payload is split into ChunkSize frames, each sealed on its own
+	// under a nonce derived from a fresh per-message base nonce. The
+	// sealed frames are still written into a single buffer sized for
+	// the whole message, and Lookup reassembles the whole payload in
+	// memory. Messages at or below ChunkSize, and all messages when ChunkSize
+	// is 0, keep using the single-frame layout.
+	ChunkSize int
+
+	// LegacyKeyID, when set, lets decrypt fall back to the envelope
+	// layout used before this header existed - a bare
+	// [nonce][ciphertext+tag], always sealed with ChaCha20-Poly1305 -
+	// for any record that fails to decrypt under the current header
+	// format.
+	// Set it to the ID of the entry in Keys holding the same key
+	// string that a pre-header NewCryptoStore was given, so a store
+	// written by that version remains readable after an upgrade. Every
+	// record written from here on still uses the current header; this
+	// only affects what decrypt accepts on read.
+	LegacyKeyID string
+
+	// LegacySubState, when true, lets the subscription-state fields
+	// (ClientID, Inbox, AckInbox, DurableName) fall back to their
+	// plaintext value whenever they don't decode and decrypt as a
+	// field CryptoSubStore wrote. Subscription state predates
+	// CryptoSubStore's encryption of it, so a store populated before
+	// encryption was enabled holds those fields as plain strings; set
+	// this to recover such a store without a fresh datastore. Messages
+	// have an equivalent path via LegacyKeyID, but sub state never had
+	// a prior encrypted format to fall back to - only plaintext - so
+	// this is a plain bool rather than a key ID.
+	LegacySubState bool
 }
 
 // CryptoMsgStore is a store wrappeing a SubStore implementation
@@ -58,11 +411,18 @@ type CryptoStore struct {
 type CryptoMsgStore struct {
 	MsgStore
 
-	cs *CryptoStore
+	cs      *CryptoStore
+	channel string
 }
 
 // NewCryptoStore returns a CryptoStore instance with
 // given underlying store.
+//
+// Every record this writes uses the keyed envelope format described on
+// CryptoStoreOptions, which is not the bare [nonce][ciphertext+tag]
+// layout used before that header existed. A store populated by an
+// older version of NewCryptoStore needs NewCryptoStoreWithOptions with
+// CryptoStoreOptions.LegacyKeyID set to stay readable after upgrading.
 func NewCryptoStore(s Store, key string) (*CryptoStore, error) {
 	if key == "" {
 		// Check env variable.
@@ -71,35 +431,172 @@ func NewCryptoStore(s Store, key string) (*CryptoStore, error) {
 			return nil, ErrCryptoStoreRequiresKey
 		}
 	}
+	return NewCryptoStoreWithKeys(s, map[string]string{cryptoStoreDefaultKeyID: key}, cryptoStoreDefaultKeyID)
+}
 
-	cs := &CryptoStore{Store: s}
+// NewCryptoStoreWithKeys returns a CryptoStore instance with the given
+// underlying store and set of keys, each identified by a stable key ID.
+// New messages are encrypted with the key identified by defaultKeyID,
+// unless a channel has been bound to a specific key with SetChannelKey.
+// All keys in the map remain available for decryption, which allows
+// messages encrypted under any of them to be recovered. It uses the
+// same cipher suite and KDF CryptoStore has always used; use
+// NewCryptoStoreWithOptions to pick different ones.
+func NewCryptoStoreWithKeys(s Store, keys map[string]string, defaultKeyID string) (*CryptoStore, error) {
+	return NewCryptoStoreWithOptions(s, CryptoStoreOptions{
+		Keys:         keys,
+		DefaultKeyID: defaultKeyID,
+		Cipher:       ChaCha20Poly1305,
+		KDF:          RawSHA256,
+	})
+}
 
-	h := sha256.New()
-	h.Write([]byte(key))
-	keyHash := h.Sum(nil)
-	gcm, err := chacha20poly1305.New(keyHash)
-	if err != nil {
-		return nil, err
+// NewCryptoStoreWithOptions returns a CryptoStore instance with the
+// given underlying store, configured per opts. It lets callers pick
+// the AEAD cipher suite (ChaCha20Poly1305, XChaCha20Poly1305,
+// AES128GCM or AES256GCM), the KDF used to derive key material from
+// opts.Keys, and, via opts.ChunkSize, whether large payloads are
+// encrypted in fixed-size frames instead of all at once. The cipher
+// suite and envelope layout are recorded in a header in every
+// encrypted message, so a store can be recovered even if it was
+// written with a mix of cipher suites and layouts across key
+// rotations and ChunkSize changes.
+func NewCryptoStoreWithOptions(s Store, opts CryptoStoreOptions) (*CryptoStore, error) {
+	if len(opts.Keys) == 0 {
+		return nil, ErrCryptoStoreRequiresKey
 	}
-	cs.gcm = gcm
-	cs.cryptoOverhead = gcm.Overhead()
-	cs.nonceSize = gcm.NonceSize()
-	if err := cs.generateNewNonce(); err != nil {
-		return nil, err
+	if _, ok := opts.Keys[opts.DefaultKeyID]; !ok {
+		return nil, ErrCryptoStoreUnknownKey
 	}
+	if opts.LegacyKeyID != "" {
+		if _, ok := opts.Keys[opts.LegacyKeyID]; !ok {
+			return nil, ErrCryptoStoreUnknownKey
+		}
+	}
+	cs := &CryptoStore{
+		Store:          s,
+		keys:           make(map[string]*cryptoKey, len(opts.Keys)),
+		channelKeys:    make(map[string]string),
+		cipher:         opts.Cipher,
+		kdf:            opts.KDF,
+		chunkSize:      opts.ChunkSize,
+		legacyKeyID:    opts.LegacyKeyID,
+		legacySubState: opts.LegacySubState,
+	}
+	for id, key := range opts.Keys {
+		ck, err := newCryptoKey(id, key, cs.cipher, cs.kdf)
+		if err != nil {
+			return nil, err
+		}
+		cs.keys[id] = ck
+	}
+	cs.defaultKeyID = opts.DefaultKeyID
 	return cs, nil
 }
 
-func (cs *CryptoStore) generateNewNonce() error {
-	nonce := make([]byte, cs.gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+// RotateKey adds newKey under newKeyID to the store and makes it the
+// key used to encrypt new messages. Messages already encrypted under
+// previously registered keys remain decryptable since those keys are
+// kept around. This allows operators to retire a compromised key
+// without having to re-encrypt the entire store. The new key uses the
+// same cipher suite and KDF the store was created with; use
+// RotateKeyWithOptions to migrate to a different one instead.
+func (cs *CryptoStore) RotateKey(newKeyID, newKey string) error {
+	cs.Lock()
+	cipherSuite, kdf := cs.cipher, cs.kdf
+	cs.Unlock()
+
+	ck, err := newCryptoKey(newKeyID, newKey, cipherSuite, kdf)
+	if err != nil {
 		return err
 	}
-	cs.nonce = nonce
-	atomic.StoreInt64(&cs.encrypted, 0)
+	cs.Lock()
+	defer cs.Unlock()
+	cs.keys[newKeyID] = ck
+	cs.defaultKeyID = newKeyID
 	return nil
 }
 
+// RotateKeyWithOptions is RotateKey for a migration that also needs to
+// change cipher suite or KDF: it adds newKey under newKeyID using
+// cipherSuite and kdf instead of reusing the ones the store was
+// created with, and makes it the key used to encrypt new messages.
+// Because encrypt records the cipher suite alongside the key ID in
+// every message's header, messages sealed under the old cipher suite
+// remain decryptable right next to ones sealed under the new one - the
+// store ends up with a genuine mix of cipher suites across keys, not
+// just key IDs, for as long as both are in cs.keys.
+func (cs *CryptoStore) RotateKeyWithOptions(newKeyID, newKey string, cipherSuite CipherSuite, kdf KDF) error {
+	ck, err := newCryptoKey(newKeyID, newKey, cipherSuite, kdf)
+	if err != nil {
+		return err
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	cs.keys[newKeyID] = ck
+	cs.defaultKeyID = newKeyID
+	return nil
+}
+
+// ForceNonceRenewal renews the nonce of every key known to the store,
+// regardless of how many encryptions have been performed under the
+// current one. It is not called anywhere in this package - a fresh
+// nonce is already generated for every key each time the process
+// starts (see newCryptoKey), and nonces are never persisted, so there
+// is nothing for a renewal to protect against across a restart. It is
+// exposed as a standalone operator API instead: for a long-running
+// process that suspects a key's nonce budget is nearing exhaustion
+// (csMaxEncryptCallsPerNonce) well before seal would renew it on its
+// own, or wants to force a renewal immediately after a RotateKey for
+// defense in depth, calling this lets an operator trigger that renewal
+// on demand without restarting the process.
+func (cs *CryptoStore) ForceNonceRenewal() error {
+	cs.Lock()
+	keys := make([]*cryptoKey, 0, len(cs.keys))
+	for _, ck := range cs.keys {
+		keys = append(keys, ck)
+	}
+	cs.Unlock()
+
+	for _, ck := range keys {
+		ck.Lock()
+		err := ck.generateNewNonce()
+		ck.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetChannelKey binds channel to the key identified by keyID, so that
+// messages stored for this channel are encrypted with that key instead
+// of the store's default key. keyID must refer to a key already known
+// to the store, either passed to NewCryptoStoreWithKeys or added later
+// through RotateKey.
+func (cs *CryptoStore) SetChannelKey(channel, keyID string) error {
+	cs.Lock()
+	defer cs.Unlock()
+	if _, ok := cs.keys[keyID]; !ok {
+		return ErrCryptoStoreUnknownKey
+	}
+	cs.channelKeys[channel] = keyID
+	return nil
+}
+
+// keyForChannel returns the cryptoKey that should be used to encrypt
+// new messages for the given channel.
+func (cs *CryptoStore) keyForChannel(channel string) *cryptoKey {
+	cs.Lock()
+	keyID, bound := cs.channelKeys[channel]
+	if !bound {
+		keyID = cs.defaultKeyID
+	}
+	ck := cs.keys[keyID]
+	cs.Unlock()
+	return ck
+}
+
 // Recover implements the Store interface
 func (cs *CryptoStore) Recover() (*RecoveredState, error) {
 	cs.Lock()
@@ -108,8 +605,19 @@ func (cs *CryptoStore) Recover() (*RecoveredState, error) {
 	if rs == nil || err != nil {
 		return rs, err
 	}
-	for _, rc := range rs.Channels {
-		rc.Channel.Msgs = &CryptoMsgStore{MsgStore: rc.Channel.Msgs, cs: cs}
+	for channel, rc := range rs.Channels {
+		rc.Channel.Msgs = &CryptoMsgStore{MsgStore: rc.Channel.Msgs, cs: cs, channel: channel}
+		rc.Channel.Subs = &CryptoSubStore{SubStore: rc.Channel.Subs, cs: cs, channel: channel}
+		for _, rsub := range rc.Subscriptions {
+			// decryptSubState takes cs's lock itself (through decrypt),
+			// so release it for the call.
+			cs.Unlock()
+			err := cs.decryptSubState(channel, rsub.Sub)
+			cs.Lock()
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	return rs, nil
 }
@@ -123,42 +631,130 @@ func (cs *CryptoStore) CreateChannel(channel string) (*Channel, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.Msgs = &CryptoMsgStore{MsgStore: c.Msgs, cs: cs}
+	c.Msgs = &CryptoMsgStore{MsgStore: c.Msgs, cs: cs, channel: channel}
+	c.Subs = &CryptoSubStore{SubStore: c.Subs, cs: cs, channel: channel}
 	return c, nil
 }
 
-func (cs *CryptoStore) encrypt(data []byte) ([]byte, error) {
-CHECK_ENCRYPTED_COUNT:
-	atomic.AddInt64(&cs.inEncrypt, 1)
-	if count := atomic.AddInt64(&cs.encrypted, 1); count >= csMaxEncryptCallsPerNonce {
-		atomic.AddInt64(&cs.inEncrypt, -1)
-		cs.Lock()
-		if count == csMaxEncryptCallsPerNonce {
-			for atomic.LoadInt64(&cs.inEncrypt) > 0 {
-				time.Sleep(15 * time.Millisecond)
-			}
-			if err := cs.generateNewNonce(); err != nil {
-				cs.Unlock()
-				return nil, err
-			}
-			cs.Unlock()
-			atomic.AddInt64(&cs.inEncrypt, 1)
-		} else {
-			cs.Unlock()
-			goto CHECK_ENCRYPTED_COUNT
-		}
+// encrypt seals data with the key currently selected for channel and
+// prepends a small header ([keyIDLen][keyID][cipherID][mode]) so that
+// decrypt can later find the right key, cipher suite and envelope
+// layout again, even after a rotation changed the default, picked a
+// different cipher suite, or ChunkSize changed.
+func (cs *CryptoStore) encrypt(channel string, data []byte) ([]byte, error) {
+	ck := cs.keyForChannel(channel)
+	cs.Lock()
+	chunkSize := cs.chunkSize
+	cs.Unlock()
+
+	mode := envelopeSingleFrame
+	var body []byte
+	var err error
+	if chunkSize > 0 && len(data) > chunkSize {
+		mode = envelopeChunked
+		body, err = ck.sealChunked(data, chunkSize)
+	} else {
+		body, err = ck.seal(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := ck.id
+	hdr := 1 + len(keyID) + 1 + 1
+	if mode == envelopeChunked {
+		hdr += 4
+	}
+	buf := make([]byte, hdr+len(body))
+	buf[0] = byte(len(keyID))
+	copy(buf[1:], keyID)
+	buf[1+len(keyID)] = byte(ck.cipher)
+	buf[1+len(keyID)+1] = mode
+	pos := 1 + len(keyID) + 2
+	if mode == envelopeChunked {
+		binary.BigEndian.PutUint32(buf[pos:], uint32(chunkSize))
+		pos += 4
 	}
-	buf := make([]byte, cs.nonceSize+cs.cryptoOverhead+len(data))
-	copy(buf, cs.nonce)
-	copy(buf[cs.nonceSize:], data)
-	dst := buf[cs.nonceSize : cs.nonceSize+len(data)]
-	ret := cs.gcm.Seal(dst[:0], cs.nonce, dst, nil)
-	atomic.AddInt64(&cs.inEncrypt, -1)
-	return buf[:cs.nonceSize+len(ret)], nil
+	copy(buf[pos:], body)
+	return buf, nil
 }
 
+// decrypt reverses encrypt. It first tries the current header format;
+// if that fails and the store was configured with a LegacyKeyID, it
+// retries assuming data is a record written before the header existed.
 func (cs *CryptoStore) decrypt(data []byte) ([]byte, error) {
-	return cs.gcm.Open(nil, data[:cs.nonceSize], data[cs.nonceSize:], nil)
+	dd, err := cs.decryptEnveloped(data)
+	if err == nil {
+		return dd, nil
+	}
+	cs.Lock()
+	legacyKeyID := cs.legacyKeyID
+	cs.Unlock()
+	if legacyKeyID == "" {
+		return nil, err
+	}
+	if dd, lerr := cs.decryptLegacy(legacyKeyID, data); lerr == nil {
+		return dd, nil
+	}
+	return nil, err
+}
+
+// decryptEnveloped reverses the [keyIDLen][keyID][cipherID][mode]
+// header encrypt prepends. It validates every length it slices on
+// before slicing, so a short or corrupt record is reported as
+// ErrCryptoStoreShortEnvelope instead of panicking.
+func (cs *CryptoStore) decryptEnveloped(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, ErrCryptoStoreShortEnvelope
+	}
+	keyIDLen := int(data[0])
+	if len(data) < 1+keyIDLen+2 {
+		return nil, ErrCryptoStoreShortEnvelope
+	}
+	keyID := string(data[1 : 1+keyIDLen])
+	cipherSuite := CipherSuite(data[1+keyIDLen])
+	mode := data[1+keyIDLen+1]
+	pos := 1 + keyIDLen + 2
+
+	cs.Lock()
+	ck, ok := cs.keys[keyID]
+	cs.Unlock()
+	if !ok {
+		return nil, ErrCryptoStoreUnknownKey
+	}
+	if ck.cipher != cipherSuite {
+		return nil, ErrCryptoStoreCipherMismatch
+	}
+
+	switch mode {
+	case envelopeSingleFrame:
+		return ck.open(data[pos:])
+	case envelopeChunked:
+		if len(data) < pos+4 {
+			return nil, ErrCryptoStoreShortEnvelope
+		}
+		chunkSize := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		return ck.openChunked(data[pos+4:], chunkSize)
+	default:
+		return nil, ErrCryptoStoreUnknownMode
+	}
+}
+
+// decryptLegacy reverses the pre-header envelope: a bare
+// [nonce][ciphertext+tag], always sealed with ChaCha20-Poly1305 under
+// the single key a pre-header NewCryptoStore was given. See
+// CryptoStoreOptions.LegacyKeyID.
+func (cs *CryptoStore) decryptLegacy(legacyKeyID string, data []byte) ([]byte, error) {
+	cs.Lock()
+	ck, ok := cs.keys[legacyKeyID]
+	cs.Unlock()
+	if !ok {
+		return nil, ErrCryptoStoreUnknownKey
+	}
+	if ck.cipher != ChaCha20Poly1305 {
+		return nil, ErrCryptoStoreCipherMismatch
+	}
+	return ck.open(data)
 }
 
 // Store implements the MsgStore interface
@@ -166,7 +762,7 @@ func (cms *CryptoMsgStore) Store(data []byte) (uint64, error) {
 	if len(data) == 0 {
 		return cms.MsgStore.Store(data)
 	}
-	ed, err := cms.cs.encrypt(data)
+	ed, err := cms.cs.encrypt(cms.channel, data)
 	if err != nil {
 		return 0, err
 	}
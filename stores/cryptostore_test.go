@@ -6,6 +6,8 @@ import (
 	"reflect"
 	"sync"
 	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
 )
 
 func TestCryptoStore(t *testing.T) {
@@ -165,7 +167,7 @@ func TestCryptoStoreRenewNonce(t *testing.T) {
 	defer cs.Close()
 
 	cs.Lock()
-	orgNonce := cs.nonce
+	orgNonce := cs.keys[cs.defaultKeyID].nonce
 	cs.Unlock()
 	c := storeCreateChannel(t, cs, "foo")
 	nr := 20
@@ -181,9 +183,473 @@ func TestCryptoStoreRenewNonce(t *testing.T) {
 	}
 	wg.Wait()
 	cs.Lock()
-	currentNonce := cs.nonce
+	currentNonce := cs.keys[cs.defaultKeyID].nonce
 	cs.Unlock()
 	if reflect.DeepEqual(orgNonce, currentNonce) {
 		t.Fatal("Nonce should have changed")
 	}
 }
+
+func TestCryptoStoreWithKeys(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	if _, err := NewCryptoStoreWithKeys(s, nil, "k1"); err != ErrCryptoStoreRequiresKey {
+		t.Fatalf("Expected error %q, got %v", ErrCryptoStoreRequiresKey, err)
+	}
+	keys := map[string]string{"k1": "key1", "k2": "key2"}
+	if _, err := NewCryptoStoreWithKeys(s, keys, "unknown"); err != ErrCryptoStoreUnknownKey {
+		t.Fatalf("Expected error %q, got %v", ErrCryptoStoreUnknownKey, err)
+	}
+	cs, err := NewCryptoStoreWithKeys(s, keys, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	c := storeCreateChannel(t, cs, "foo")
+	seq := storeMsg(t, c, "foo", []byte("hello"))
+	m := msgStoreLookup(t, c.Msgs, seq)
+	if !reflect.DeepEqual(m.Data, []byte("hello")) {
+		t.Fatalf("Unexpected message: %v", string(m.Data))
+	}
+}
+
+func TestCryptoStoreWithOptions(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		cipher CipherSuite
+		kdf    KDF
+	}{
+		{"chacha20poly1305/raw", ChaCha20Poly1305, RawSHA256},
+		{"xchacha20poly1305/pbkdf2", XChaCha20Poly1305, PBKDF2SHA256},
+		{"aes128gcm/scrypt", AES128GCM, Scrypt},
+		{"aes256gcm/argon2id", AES256GCM, Argon2id},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := createDefaultMemStore(t)
+			defer s.Close()
+
+			os.Unsetenv(CryptoStoreEnvKeyName)
+
+			cs, err := NewCryptoStoreWithOptions(s, CryptoStoreOptions{
+				Keys:         map[string]string{"k1": "key1"},
+				DefaultKeyID: "k1",
+				Cipher:       test.cipher,
+				KDF:          test.kdf,
+			})
+			if err != nil {
+				t.Fatalf("Error creating store: %v", err)
+			}
+			defer cs.Close()
+
+			c := storeCreateChannel(t, cs, "foo")
+			seq := storeMsg(t, c, "foo", []byte("hello"))
+			m := msgStoreLookup(t, c.Msgs, seq)
+			if !reflect.DeepEqual(m.Data, []byte("hello")) {
+				t.Fatalf("Unexpected message: %v", string(m.Data))
+			}
+		})
+	}
+}
+
+func TestCryptoStoreCipherMismatch(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	cs, err := NewCryptoStoreWithOptions(s, CryptoStoreOptions{
+		Keys:         map[string]string{"k1": "key1"},
+		DefaultKeyID: "k1",
+		Cipher:       AES256GCM,
+	})
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	ed, err := cs.encrypt("foo", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	// Corrupt the cipher ID byte in the envelope so that it no longer
+	// matches the cipher the key was created with.
+	ed[1+len("k1")] = byte(ChaCha20Poly1305)
+
+	if _, err := cs.decrypt(ed); err != ErrCryptoStoreCipherMismatch {
+		t.Fatalf("Expected error %q, got %v", ErrCryptoStoreCipherMismatch, err)
+	}
+}
+
+func TestCryptoStoreRotateKey(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	cs, err := NewCryptoStoreWithKeys(s, map[string]string{"k1": "key1"}, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	c := storeCreateChannel(t, cs, "foo")
+	seq1 := storeMsg(t, c, "foo", []byte("before rotation"))
+
+	if err := cs.RotateKey("k2", "key2"); err != nil {
+		t.Fatalf("Error rotating key: %v", err)
+	}
+	seq2 := storeMsg(t, c, "foo", []byte("after rotation"))
+
+	// Messages encrypted under both the old and the new key
+	// should still be readable.
+	m1 := msgStoreLookup(t, c.Msgs, seq1)
+	if !reflect.DeepEqual(m1.Data, []byte("before rotation")) {
+		t.Fatalf("Unexpected message: %v", string(m1.Data))
+	}
+	m2 := msgStoreLookup(t, c.Msgs, seq2)
+	if !reflect.DeepEqual(m2.Data, []byte("after rotation")) {
+		t.Fatalf("Unexpected message: %v", string(m2.Data))
+	}
+}
+
+func TestCryptoStoreRotateKeyWithCipher(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	cs, err := NewCryptoStoreWithKeys(s, map[string]string{"k1": "key1"}, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	c := storeCreateChannel(t, cs, "foo")
+	seq1 := storeMsg(t, c, "foo", []byte("before migration"))
+
+	if err := cs.RotateKeyWithOptions("k2", "key2", AES256GCM, Argon2id); err != nil {
+		t.Fatalf("Error rotating key: %v", err)
+	}
+	seq2 := storeMsg(t, c, "foo", []byte("after migration"))
+
+	// The store should now hold a genuine mix of cipher suites: seq1
+	// under k1's original ChaCha20Poly1305, seq2 under k2's AES256GCM.
+	ck1 := cs.keyForChannel("foo")
+	if ck1.id != "k2" || ck1.cipher != AES256GCM {
+		t.Fatalf("Expected channel key to be k2/AES256GCM, got %v/%v", ck1.id, ck1.cipher)
+	}
+	m1 := msgStoreLookup(t, c.Msgs, seq1)
+	if !reflect.DeepEqual(m1.Data, []byte("before migration")) {
+		t.Fatalf("Unexpected message: %v", string(m1.Data))
+	}
+	m2 := msgStoreLookup(t, c.Msgs, seq2)
+	if !reflect.DeepEqual(m2.Data, []byte("after migration")) {
+		t.Fatalf("Unexpected message: %v", string(m2.Data))
+	}
+}
+
+func TestCryptoStoreSetChannelKey(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	keys := map[string]string{"k1": "key1", "k2": "key2"}
+	cs, err := NewCryptoStoreWithKeys(s, keys, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	if err := cs.SetChannelKey("foo", "unknown"); err != ErrCryptoStoreUnknownKey {
+		t.Fatalf("Expected error %q, got %v", ErrCryptoStoreUnknownKey, err)
+	}
+	if err := cs.SetChannelKey("foo", "k2"); err != nil {
+		t.Fatalf("Error setting channel key: %v", err)
+	}
+
+	c := storeCreateChannel(t, cs, "foo")
+	seq := storeMsg(t, c, "foo", []byte("hello"))
+	m := msgStoreLookup(t, c.Msgs, seq)
+	if !reflect.DeepEqual(m.Data, []byte("hello")) {
+		t.Fatalf("Unexpected message: %v", string(m.Data))
+	}
+}
+
+func TestCryptoStoreChunked(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	cs, err := NewCryptoStoreWithOptions(s, CryptoStoreOptions{
+		Keys:         map[string]string{"k1": "key1"},
+		DefaultKeyID: "k1",
+		ChunkSize:    16,
+	})
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	c := storeCreateChannel(t, cs, "foo")
+
+	// Below, at, and above the chunk size, and not an exact multiple
+	// of it, to exercise the last partial frame.
+	payloads := [][]byte{
+		[]byte("short"),
+		make([]byte, 16),
+		make([]byte, 40),
+		make([]byte, 100),
+	}
+	for i := range payloads {
+		for j := range payloads[i] {
+			payloads[i][j] = byte(i*31 + j)
+		}
+	}
+
+	for _, p := range payloads {
+		seq := storeMsg(t, c, "foo", p)
+		m := msgStoreLookup(t, c.Msgs, seq)
+		if !reflect.DeepEqual(m.Data, p) {
+			t.Fatalf("Unexpected message of len %d: got len %d", len(p), len(m.Data))
+		}
+	}
+}
+
+func TestCryptoSubStoreEncryptDecrypt(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	cs, err := NewCryptoStoreWithKeys(s, map[string]string{"k1": "key1"}, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	storeCreateChannel(t, cs, "foo")
+
+	orig := spb.SubState{
+		ClientID:    "client1",
+		Inbox:       "inbox1",
+		AckInbox:    "ackInbox1",
+		DurableName: "durable1",
+	}
+	esub, err := cs.encryptedSubState("foo", &orig)
+	if err != nil {
+		t.Fatalf("Error encrypting sub state: %v", err)
+	}
+	if esub.ClientID == orig.ClientID || esub.Inbox == orig.Inbox ||
+		esub.AckInbox == orig.AckInbox || esub.DurableName == orig.DurableName {
+		t.Fatalf("Expected sub state fields to be encrypted, got %#v", esub)
+	}
+	if orig.ClientID != "client1" || orig.Inbox != "inbox1" ||
+		orig.AckInbox != "ackInbox1" || orig.DurableName != "durable1" {
+		t.Fatalf("Expected original sub state to be left untouched, got %#v", orig)
+	}
+	sub := *esub
+	if err := cs.decryptSubState("foo", &sub); err != nil {
+		t.Fatalf("Error decrypting sub state: %v", err)
+	}
+	if !reflect.DeepEqual(sub, orig) {
+		t.Fatalf("Expected %#v, got %#v", orig, sub)
+	}
+}
+
+func TestCryptoSubStoreCreateSub(t *testing.T) {
+	cleanupFSDatastore(t)
+	defer cleanupFSDatastore(t)
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	s := createDefaultFileStore(t)
+	cs, err := NewCryptoStoreWithKeys(s, map[string]string{"k1": "key1"}, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+
+	c := storeCreateChannel(t, cs, "foo")
+
+	sub := &spb.SubState{
+		ClientID:    "client1",
+		Inbox:       "inbox1",
+		AckInbox:    "ackInbox1",
+		DurableName: "durable1",
+	}
+	if err := c.Subs.CreateSub(sub); err != nil {
+		t.Fatalf("Error creating sub: %v", err)
+	}
+	// The server keeps using this struct for live routing (subscribing
+	// to AckInbox, delivering to Inbox, looking up ClientID), so
+	// CreateSub must leave it untouched.
+	if sub.ClientID != "client1" || sub.Inbox != "inbox1" ||
+		sub.AckInbox != "ackInbox1" || sub.DurableName != "durable1" {
+		t.Fatalf("Expected caller's sub state to be left untouched, got %#v", sub)
+	}
+	cs.Close()
+
+	// Reopen without the crypto wrapper: what was actually persisted
+	// should be encrypted, not the plaintext values above.
+	s, rs := openDefaultFileStore(t)
+	rc := getRecoveredChannel(t, rs, "foo")
+	if len(rc.Subscriptions) != 1 {
+		t.Fatalf("Expected 1 subscription, got %v", len(rc.Subscriptions))
+	}
+	raw := rc.Subscriptions[0].Sub
+	if raw.ClientID == "client1" || raw.Inbox == "inbox1" ||
+		raw.AckInbox == "ackInbox1" || raw.DurableName == "durable1" {
+		t.Fatalf("Expected persisted sub state to be encrypted, got %#v", raw)
+	}
+	s.Close()
+}
+
+func TestCryptoSubStoreLegacySubState(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	// Simulate a subscription record written before sub-state encryption
+	// was enabled: the identifying fields are plain strings, not the
+	// base64-encoded envelopes encryptSubStateField produces.
+	plain := spb.SubState{
+		ClientID:    "client1",
+		Inbox:       "inbox1",
+		AckInbox:    "ackInbox1",
+		DurableName: "durable1",
+	}
+
+	cs, err := NewCryptoStoreWithOptions(s, CryptoStoreOptions{
+		Keys:           map[string]string{"k1": "key1"},
+		DefaultKeyID:   "k1",
+		LegacySubState: true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	sub := plain
+	if err := cs.decryptSubState("foo", &sub); err != nil {
+		t.Fatalf("Error decrypting plaintext sub state: %v", err)
+	}
+	if !reflect.DeepEqual(sub, plain) {
+		t.Fatalf("Expected plaintext sub state to pass through unchanged, got %#v", sub)
+	}
+
+	// Without LegacySubState configured, the same record should fail.
+	cs2, err := NewCryptoStoreWithKeys(s, map[string]string{"k1": "key1"}, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs2.Close()
+	sub2 := plain
+	if err := cs2.decryptSubState("foo", &sub2); err == nil {
+		t.Fatalf("Expected error decrypting plaintext sub state without LegacySubState set")
+	}
+}
+
+func TestCryptoStoreForceNonceRenewal(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	keys := map[string]string{"k1": "key1", "k2": "key2"}
+	cs, err := NewCryptoStoreWithKeys(s, keys, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	cs.Lock()
+	orgNonces := make(map[string][]byte, len(cs.keys))
+	for id, ck := range cs.keys {
+		orgNonces[id] = ck.nonce
+	}
+	cs.Unlock()
+
+	if err := cs.ForceNonceRenewal(); err != nil {
+		t.Fatalf("Error renewing nonces: %v", err)
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+	for id, ck := range cs.keys {
+		if reflect.DeepEqual(orgNonces[id], ck.nonce) {
+			t.Fatalf("Nonce for key %q should have changed", id)
+		}
+	}
+}
+
+func TestCryptoStoreDecryptShortEnvelope(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	cs, err := NewCryptoStoreWithKeys(s, map[string]string{"k1": "key1"}, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	for _, data := range [][]byte{nil, {}, {0}, {3, 'k', '1'}} {
+		if _, err := cs.decrypt(data); err != ErrCryptoStoreShortEnvelope {
+			t.Fatalf("Expected error %q for %v, got %v", ErrCryptoStoreShortEnvelope, data, err)
+		}
+	}
+}
+
+func TestCryptoStoreLegacyKeyID(t *testing.T) {
+	s := createDefaultMemStore(t)
+	defer s.Close()
+
+	os.Unsetenv(CryptoStoreEnvKeyName)
+
+	// Simulate a record written by a pre-header CryptoStore: a bare
+	// [nonce][ciphertext+tag] sealed with ChaCha20-Poly1305 under a
+	// single implicit key.
+	legacy, err := newCryptoKey("legacy", "legacykey", ChaCha20Poly1305, RawSHA256)
+	if err != nil {
+		t.Fatalf("Error creating legacy key: %v", err)
+	}
+	ed, err := legacy.seal([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Error sealing: %v", err)
+	}
+
+	cs, err := NewCryptoStoreWithOptions(s, CryptoStoreOptions{
+		Keys:         map[string]string{"k1": "key1", "legacy": "legacykey"},
+		DefaultKeyID: "k1",
+		LegacyKeyID:  "legacy",
+	})
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs.Close()
+
+	dd, err := cs.decrypt(ed)
+	if err != nil {
+		t.Fatalf("Error decrypting legacy envelope: %v", err)
+	}
+	if !reflect.DeepEqual(dd, []byte("hello")) {
+		t.Fatalf("Unexpected result: %v", string(dd))
+	}
+
+	// Without LegacyKeyID configured, the same record should not decrypt.
+	cs2, err := NewCryptoStoreWithKeys(s, map[string]string{"k1": "key1", "legacy": "legacykey"}, "k1")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer cs2.Close()
+	if _, err := cs2.decrypt(ed); err == nil {
+		t.Fatalf("Expected error decrypting legacy envelope without LegacyKeyID set")
+	}
+}